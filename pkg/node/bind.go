@@ -0,0 +1,57 @@
+// This file is part of MinIO Kubernetes Cloud
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ensureBlockTargetFile satisfies the kubelet contract for block-mode publish: the
+// parent directory and an empty regular file must exist at targetPath for Bind to
+// mount onto.
+func ensureBlockTargetFile(targetPath string) error {
+	if _, err := os.Stat(targetPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(targetPath, os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// cleanupTargetFile removes the placeholder regular file ensureBlockTargetFile creates
+// for a block-mode publish. Removal is unconditional and idempotent - matching how
+// Unbind is already treated - rather than gated on in-memory tracking of which targets
+// this node plugin created, since that tracking wouldn't survive a node plugin restart
+// between NodePublishVolume and the matching NodeUnpublishVolume. Callers only invoke
+// this for block-accessible volumes, so targetPath is always this placeholder file, not
+// a CO-managed mount directory.
+func cleanupTargetFile(targetPath string) error {
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
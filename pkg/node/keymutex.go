@@ -0,0 +1,63 @@
+// This file is part of MinIO Kubernetes Cloud
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// KeyMutex serializes operations keyed by an arbitrary string, such as a volume ID, so
+// that overlapping Node RPCs for the same volume (kubelet retries in particular) don't
+// race each other. Modeled on Kubernetes' keymutex.KeyMutex.
+type KeyMutex interface {
+	LockKey(key string)
+	UnlockKey(key string)
+}
+
+// keyMutexBuckets is the fixed number of mutexes a hashed KeyMutex spreads keys across.
+// It's sized well above MaxVolumes so two different volume IDs landing in the same
+// bucket (and briefly serializing each other unnecessarily) stays rare, while keeping
+// memory bounded no matter how many distinct volume IDs a long-running node plugin sees
+// over its lifetime.
+const keyMutexBuckets = 65536
+
+// NewKeyMutex returns a KeyMutex backed by a fixed-size array of mutexes, hashing each
+// key to a bucket. Modeled on Kubernetes' keymutex.NewHashedKeyMutex: unlike one mutex
+// per distinct key, its memory footprint never grows, however many keys are locked over
+// the life of the process.
+func NewKeyMutex() KeyMutex {
+	return &keyMutex{locks: make([]sync.Mutex, keyMutexBuckets)}
+}
+
+type keyMutex struct {
+	locks []sync.Mutex
+}
+
+func (k *keyMutex) LockKey(key string) {
+	k.locks[bucketFor(key, len(k.locks))].Lock()
+}
+
+func (k *keyMutex) UnlockKey(key string) {
+	k.locks[bucketFor(key, len(k.locks))].Unlock()
+}
+
+func bucketFor(key string, buckets int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % uint32(buckets)
+}
@@ -0,0 +1,162 @@
+// This file is part of MinIO Kubernetes Cloud
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// luksStateFile records, per volume ID, the dm-crypt mapper name cryptsetup opened for
+// it on stage. NodeStageVolume/NodeUnstageVolume keep it up to date so a restarted node
+// plugin can tell which volumes it still has unlocked without rescanning /dev/mapper.
+const luksStateFile = "/var/lib/jbod-csi-driver/luks-state.json"
+
+// luksMapperName is the dm-crypt mapping name cryptsetup luksOpen creates for a volume,
+// i.e. the device ends up at /dev/mapper/<luksMapperName(volID)>.
+func luksMapperName(volID string) string {
+	return "csi-" + volID
+}
+
+// luksMappingOpen reports whether the dm-crypt mapping for volID exists under /dev/mapper.
+func luksMappingOpen(volID string) bool {
+	_, err := os.Stat(filepath.Join("/dev/mapper", luksMapperName(volID)))
+	return err == nil
+}
+
+type luksState struct {
+	mu       sync.Mutex
+	path     string
+	mappings map[string]string // volume ID -> mapper name
+}
+
+func newLuksState(path string) *luksState {
+	s := &luksState{path: path, mappings: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("unable to read LUKS state file %s: %v", path, err)
+		}
+		return s
+	}
+
+	if err := json.Unmarshal(data, &s.mappings); err != nil {
+		glog.Errorf("unable to parse LUKS state file %s: %v", path, err)
+		s.mappings = make(map[string]string)
+		return s
+	}
+
+	s.reconcile()
+	return s
+}
+
+// reconcile drops any recorded mapping whose /dev/mapper entry no longer exists (the
+// node rebooted, or something else tore the mapping down out-of-band) and logs what's
+// actually being resumed, so a restarted node plugin's in-memory view matches what
+// cryptsetup still has open rather than just replaying whatever was last written.
+func (s *luksState) reconcile() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []string
+	for volID, mapperName := range s.mappings {
+		if _, err := os.Stat(filepath.Join("/dev/mapper", mapperName)); err != nil {
+			stale = append(stale, volID)
+		}
+	}
+
+	for _, volID := range stale {
+		delete(s.mappings, volID)
+	}
+
+	if len(stale) > 0 {
+		glog.Warningf("dropping %d stale LUKS mapping(s) no longer present under /dev/mapper: %v", len(stale), stale)
+		if err := s.save(); err != nil {
+			glog.Errorf("unable to persist reconciled LUKS state to %s: %v", s.path, err)
+		}
+	}
+
+	glog.Infof("resuming management of %d LUKS mapping(s) from %s", len(s.mappings), s.path)
+}
+
+// mapperFor returns the dm-crypt mapper name recorded for volID, if NodeStageVolume
+// recorded one for it (i.e. the volume was staged LUKS-encrypted).
+func (s *luksState) mapperFor(volID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name, ok := s.mappings[volID]
+	return name, ok
+}
+
+func (s *luksState) record(volID, mapperName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mappings[volID] = mapperName
+	return s.save()
+}
+
+func (s *luksState) forget(volID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.mappings[volID]; !ok {
+		return nil
+	}
+	delete(s.mappings, volID)
+	return s.save()
+}
+
+// save must be called with s.mu held. It writes via a temp file and rename so a crash
+// mid-write can't leave behind a truncated state file that wipes every mapping on the
+// next load.
+func (s *luksState) save() error {
+	data, err := json.Marshal(s.mappings)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,111 @@
+// This file is part of MinIO Kubernetes Cloud
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLuksStateRecordForgetRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "luks-state.json")
+
+	s := newLuksState(path)
+	if len(s.mappings) != 0 {
+		t.Fatalf("expected empty state for nonexistent file, got %v", s.mappings)
+	}
+
+	if err := s.record("vol-1", luksMapperName("vol-1")); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading persisted state: %v", err)
+	}
+
+	var onDisk map[string]string
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		t.Fatalf("unmarshaling persisted state: %v", err)
+	}
+	if onDisk["vol-1"] != luksMapperName("vol-1") {
+		t.Fatalf("expected persisted mapping csi-vol-1, got %q", onDisk["vol-1"])
+	}
+
+	if err := s.forget("vol-1"); err != nil {
+		t.Fatalf("forget: %v", err)
+	}
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading persisted state after forget: %v", err)
+	}
+	onDisk = nil
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		t.Fatalf("unmarshaling persisted state after forget: %v", err)
+	}
+	if _, ok := onDisk["vol-1"]; ok {
+		t.Fatalf("expected vol-1 to be removed from persisted state, got %v", onDisk)
+	}
+}
+
+func TestLuksStateForgetUnknownVolumeIsNoop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "luks-state.json")
+	s := newLuksState(path)
+
+	if err := s.forget("never-recorded"); err != nil {
+		t.Fatalf("forget on unknown volume should be a no-op, got error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("forget on unknown volume should not create a state file, stat err = %v", err)
+	}
+}
+
+func TestNewLuksStateDropsStaleMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "luks-state.json")
+
+	seed := map[string]string{"vol-stale": luksMapperName("vol-stale")}
+	data, err := json.Marshal(seed)
+	if err != nil {
+		t.Fatalf("marshaling seed state: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing seed state: %v", err)
+	}
+
+	// /dev/mapper/csi-vol-stale does not exist in the test environment, so loading the
+	// state should reconcile it away rather than resuming management of a mapping that
+	// isn't actually open anymore.
+	s := newLuksState(path)
+	if _, ok := s.mappings["vol-stale"]; ok {
+		t.Fatalf("expected stale mapping to be dropped on load, got %v", s.mappings)
+	}
+
+	persisted, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading reconciled state: %v", err)
+	}
+	var onDisk map[string]string
+	if err := json.Unmarshal(persisted, &onDisk); err != nil {
+		t.Fatalf("unmarshaling reconciled state: %v", err)
+	}
+	if len(onDisk) != 0 {
+		t.Fatalf("expected reconciled state to be persisted without the stale entry, got %v", onDisk)
+	}
+}
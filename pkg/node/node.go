@@ -32,11 +32,13 @@ const MaxVolumes = 10000
 
 func NewNodeServer(identity, nodeID, rack, zone, region string) (*NodeServer, error) {
 	return &NodeServer{
-		NodeID:   nodeID,
-		Identity: identity,
-		Rack:     rack,
-		Zone:     zone,
-		Region:   region,
+		NodeID:      nodeID,
+		Identity:    identity,
+		Rack:        rack,
+		Zone:        zone,
+		Region:      region,
+		VolumeLocks: NewKeyMutex(),
+		luks:        newLuksState(luksStateFile),
 	}, nil
 }
 
@@ -46,6 +48,12 @@ type NodeServer struct {
 	Rack     string
 	Zone     string
 	Region   string
+
+	// VolumeLocks serializes Node RPCs per volume ID. Exported so tests can inject a
+	// fake KeyMutex.
+	VolumeLocks KeyMutex
+
+	luks *luksState
 }
 
 func (n *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
@@ -84,10 +92,152 @@ func (n *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 			nodeCap(csi.NodeServiceCapability_RPC_VOLUME_CONDITION),
 			nodeCap(csi.NodeServiceCapability_RPC_GET_VOLUME_STATS),
 			nodeCap(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME),
+			nodeCap(csi.NodeServiceCapability_RPC_EXPAND_VOLUME),
 		},
 	}, nil
 }
 
+func (n *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	vID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+	vCap := req.GetVolumeCapability()
+	vCtx := req.GetVolumeContext()
+	secrets := req.GetSecrets()
+
+	if vID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	if vCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+
+	n.VolumeLocks.LockKey(vID)
+	defer n.VolumeLocks.UnlockKey(vID)
+
+	vol, err := volume.GetVolume(ctx, vID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if vol.StagingPath != "" && vol.StagingPath != stagingPath {
+		return nil, status.Error(codes.AlreadyExists, "volume is already staged at a different path")
+	}
+
+	staged, err := vol.IsStaged(stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if staged {
+		glog.V(5).Infof("volume %s is already staged at %s, skipping", vID, stagingPath)
+		if len(secrets) > 0 && luksMappingOpen(vID) {
+			if err := n.luks.record(vID, luksMapperName(vID)); err != nil {
+				glog.Errorf("failed to persist LUKS state for volume %s: %v", vID, err)
+			}
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if vMount := vCap.GetMount(); vMount != nil {
+		if !vol.IsMountAccessible() {
+			return nil, status.Error(codes.InvalidArgument, "volume does not support mount access")
+		}
+
+		fs := vMount.GetFsType()
+		flags := vMount.GetMountFlags()
+
+		// Stage resolves the backing device on this node (scanning /dev/disk/by-id and
+		// /sys/block to follow multipath/dm-N devices through to the real disk), unlocks
+		// it via secrets if it's LUKS-encrypted, formats it with fs if it isn't formatted
+		// yet, and mounts it at stagingPath. vCtx is persisted against the volume so
+		// topology/plugin hints survive the controller->node transition.
+		if err := vol.Stage(stagingPath, fs, flags, vCtx, secrets); err != nil {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if vCap.GetBlock() != nil {
+		if !vol.IsBlockAccessible() {
+			return nil, status.Error(codes.InvalidArgument, "volume does not support block access")
+		}
+
+		// Block volumes have nothing to format or mount; staging only needs to resolve
+		// and record the backing device (unlocking it first if it's LUKS-encrypted) so
+		// NodePublishVolume can bind-mount it.
+		if err := vol.StageBlock(stagingPath, vCtx, secrets); err != nil {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		return nil, status.Error(codes.InvalidArgument, "volume capability request contains neither mount and block access")
+	}
+
+	if len(secrets) > 0 && luksMappingOpen(vID) {
+		if err := n.luks.record(vID, luksMapperName(vID)); err != nil {
+			glog.Errorf("failed to persist LUKS state for volume %s: %v", vID, err)
+		}
+	}
+
+	glog.V(5).Infof("staged volume %s at %s successfully", vID, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (n *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	vID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+
+	if vID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	n.VolumeLocks.LockKey(vID)
+	defer n.VolumeLocks.UnlockKey(vID)
+
+	vol, err := volume.GetVolume(ctx, vID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	staged, err := vol.IsStaged(stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !staged {
+		glog.V(5).Infof("volume %s is not staged at %s, skipping", vID, stagingPath)
+		if err := n.luks.forget(vID); err != nil {
+			glog.Errorf("failed to update LUKS state for volume %s: %v", vID, err)
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	if err := vol.Unstage(stagingPath); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Unstage already closed any LUKS mapping it opened; drop our record of it so a
+	// restarted node plugin doesn't think it still needs managing.
+	if err := n.luks.forget(vID); err != nil {
+		glog.Errorf("failed to update LUKS state for volume %s: %v", vID, err)
+	}
+
+	glog.V(5).Infof("unstaged volume %s from %s successfully", vID, stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
 func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	vID := req.GetVolumeId()
 	ro := req.GetReadonly()
@@ -95,11 +245,15 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	stagingPath := req.GetStagingTargetPath()
 	vCtx := req.GetVolumeContext()
 	vCap := req.GetVolumeCapability()
+	secrets := req.GetSecrets()
 
 	if vID == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
 	}
 
+	n.VolumeLocks.LockKey(vID)
+	defer n.VolumeLocks.UnlockKey(vID)
+
 	vol, err := volume.GetVolume(ctx, vID)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, err.Error())
@@ -133,7 +287,16 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 			return nil, status.Error(codes.InvalidArgument, "volume does not support block access")
 		}
 
-		if err := vol.Bind(targetPath, ro, vCtx); err != nil {
+		// The CO is expected to have created targetPath already, but create it
+		// defensively (parent dir + empty regular file) before Bind bind-mounts the
+		// backing block device resolved during staging (or, for file-backed volumes on
+		// shared JBODs, a loop device over the staged file) onto it, remounting
+		// MS_RDONLY when ro is set.
+		if err := ensureBlockTargetFile(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create target path %s: %v", targetPath, err)
+		}
+
+		if err := vol.Bind(stagingPath, targetPath, ro, vCtx, secrets); err != nil {
 			if _, ok := status.FromError(err); ok {
 				return nil, err
 			}
@@ -142,15 +305,15 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		glog.V(5).Infof("published block access request for volume %s successfully", vID)
 	}
 
-	if vMount := vCap.GetMount(); vMount != nil {
+	if vCap.GetMount() != nil {
 		if !vol.IsMountAccessible() {
 			return nil, status.Error(codes.InvalidArgument, "volume does not support mount access")
 		}
 
-		fs := vMount.GetFsType()
-		flags := vMount.GetMountFlags()
-
-		if err := vol.Mount(targetPath, fs, flags, ro, vCtx); err != nil {
+		// The filesystem is already mounted at stagingPath by NodeStageVolume; publish
+		// only needs to bind-mount it into the target path, so it reuses the same Bind
+		// used for block access.
+		if err := vol.Bind(stagingPath, targetPath, ro, vCtx, secrets); err != nil {
 			if _, ok := status.FromError(err); ok {
 				return nil, err
 			}
@@ -160,3 +323,49 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
+
+func (n *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	vID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+
+	if vID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+
+	n.VolumeLocks.LockKey(vID)
+	defer n.VolumeLocks.UnlockKey(vID)
+
+	vol, err := volume.GetVolume(ctx, vID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if _, ok := vol.ContainsTargetPaths(targetPath); !ok {
+		glog.V(5).Infof("volume %s is not published at %s, skipping", vID, targetPath)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	// Unbind tears down the bind mount Bind set up (block device, loop device, or
+	// staged-filesystem bind) and drops targetPath from the volume's tracked paths.
+	if err := vol.Unbind(targetPath); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Only block-mode publish ever creates a placeholder regular file at targetPath;
+	// for mount volumes targetPath is a CO-managed directory that isn't ours to remove.
+	if vol.IsBlockAccessible() {
+		if err := cleanupTargetFile(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove target path %s: %v", targetPath, err)
+		}
+	}
+
+	glog.V(5).Infof("unpublished volume %s from %s successfully", vID, targetPath)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
@@ -0,0 +1,206 @@
+// This file is part of MinIO Kubernetes Cloud
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeKeyMutex is the fake KeyMutex VolumeLocks is exported to let tests inject: it
+// records every Lock/Unlock call so a test can assert a handler took the lock exactly
+// once and released it, even on an early-return error path.
+type fakeKeyMutex struct {
+	locks   []string
+	unlocks []string
+}
+
+func (f *fakeKeyMutex) LockKey(key string)   { f.locks = append(f.locks, key) }
+func (f *fakeKeyMutex) UnlockKey(key string) { f.unlocks = append(f.unlocks, key) }
+
+func newTestNodeServer() (*NodeServer, *fakeKeyMutex) {
+	locks := &fakeKeyMutex{}
+	return &NodeServer{
+		VolumeLocks: locks,
+		luks:        newLuksState("/dev/null/unused"),
+	}, locks
+}
+
+// Validation failures (missing volume ID, missing staging path, ...) must return before
+// ever taking the per-volume lock, since every handler validates its request first.
+func TestNodeRPCsDontLockOnValidationFailure(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		call func(*NodeServer) error
+	}{
+		{
+			name: "NodeStageVolume missing volume ID",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{})
+				return err
+			},
+		},
+		{
+			name: "NodeUnstageVolume missing staging path",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+		},
+		{
+			name: "NodePublishVolume missing volume ID",
+			call: func(n *NodeServer) error {
+				_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{})
+				return err
+			},
+		},
+		{
+			name: "NodeUnpublishVolume missing target path",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+		},
+		{
+			name: "NodeGetVolumeStats missing volume path",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1"})
+				return err
+			},
+		},
+		{
+			name: "NodeExpandVolume missing volume path",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: "vol-1"})
+				return err
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, locks := newTestNodeServer()
+
+			err := tc.call(n)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("expected InvalidArgument, got %v", err)
+			}
+			if len(locks.locks) != 0 || len(locks.unlocks) != 0 {
+				t.Fatalf("expected no locking on a validation failure, got locks=%v unlocks=%v", locks.locks, locks.unlocks)
+			}
+		})
+	}
+}
+
+// Once a request passes validation, every RPC locks its volume ID and must release it
+// again symmetrically - including on an early return from a failed volume lookup,
+// which is the only outcome volume.GetVolume can produce against a volume ID that was
+// never provisioned.
+func TestNodeRPCsUnlockOnVolumeLookupFailure(t *testing.T) {
+	ctx := context.Background()
+	const vID = "does-not-exist"
+
+	cases := []struct {
+		name string
+		call func(*NodeServer) error
+	}{
+		{
+			name: "NodeStageVolume",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+					VolumeId:          vID,
+					StagingTargetPath: "/staging/path",
+					VolumeCapability:  &csi.VolumeCapability{},
+				})
+				return err
+			},
+		},
+		{
+			name: "NodeUnstageVolume",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+					VolumeId:          vID,
+					StagingTargetPath: "/staging/path",
+				})
+				return err
+			},
+		},
+		{
+			name: "NodePublishVolume",
+			call: func(n *NodeServer) error {
+				_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+					VolumeId:   vID,
+					TargetPath: "/target/path",
+				})
+				return err
+			},
+		},
+		{
+			name: "NodeUnpublishVolume",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+					VolumeId:   vID,
+					TargetPath: "/target/path",
+				})
+				return err
+			},
+		},
+		{
+			name: "NodeGetVolumeStats",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+					VolumeId:   vID,
+					VolumePath: "/volume/path",
+				})
+				return err
+			},
+		},
+		{
+			name: "NodeExpandVolume",
+			call: func(n *NodeServer) error {
+				_, err := n.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+					VolumeId:   vID,
+					VolumePath: "/volume/path",
+				})
+				return err
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, locks := newTestNodeServer()
+
+			if err := tc.call(n); err == nil {
+				t.Fatalf("expected a lookup error for an unprovisioned volume, got nil")
+			}
+
+			if len(locks.locks) != 1 || locks.locks[0] != vID {
+				t.Fatalf("expected exactly one lock on %q, got %v", vID, locks.locks)
+			}
+			if len(locks.unlocks) != 1 || locks.unlocks[0] != vID {
+				t.Fatalf("expected exactly one unlock on %q, got %v", vID, locks.unlocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// This file is part of MinIO Kubernetes Cloud
+// Copyright (c) 2020 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/minio/jbod-csi-driver/pkg/volume"
+	"golang.org/x/sys/unix"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (n *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	vID := req.GetVolumeId()
+	volPath := req.GetVolumePath()
+
+	if vID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if volPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	n.VolumeLocks.LockKey(vID)
+	defer n.VolumeLocks.UnlockKey(vID)
+
+	vol, err := volume.GetVolume(ctx, vID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if _, err := os.Stat(volPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volPath)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	condition := n.volumeCondition(volPath)
+
+	if vol.IsBlockAccessible() {
+		// volPath is the published device node itself, so it can be queried directly.
+		total, err := blockDeviceSize(volPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: total},
+			},
+			VolumeCondition: condition,
+		}, nil
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(volPath, &stat); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to statfs %s: %v", volPath, err)
+	}
+
+	blockSize := uint64(stat.Bsize)
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(stat.Blocks * blockSize),
+				Available: int64(stat.Bavail * blockSize),
+				Used:      int64((stat.Blocks - stat.Bfree) * blockSize),
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(stat.Files),
+				Available: int64(stat.Ffree),
+				Used:      int64(stat.Files - stat.Ffree),
+			},
+		},
+		VolumeCondition: condition,
+	}, nil
+}
+
+func (n *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	vID := req.GetVolumeId()
+	volPath := req.GetVolumePath()
+	requiredBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	if vID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if volPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	n.VolumeLocks.LockKey(vID)
+	defer n.VolumeLocks.UnlockKey(vID)
+
+	vol, err := volume.GetVolume(ctx, vID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	// Block volumes have no filesystem to grow; the new capacity is already visible to
+	// whatever reads the backing device directly.
+	if vol.IsBlockAccessible() {
+		glog.V(5).Infof("volume %s is block-accessible, skipping filesystem expansion", vID)
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: requiredBytes}, nil
+	}
+
+	device, err := deviceForPath(volPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// device is the dm-crypt mapper, not the physical disk, when this volume was staged
+	// LUKS-encrypted; growing the backing disk alone doesn't extend the mapper, so the
+	// filesystem resize below would find no extra space until cryptsetup catches it up.
+	if mapperName, ok := n.luks.mapperFor(vID); ok {
+		if err := resizeLuksMapping(mapperName); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resize LUKS mapping for volume %s: %v", vID, err)
+		}
+	}
+
+	fsType, err := filesystemType(device)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := growFilesystem(fsType, device, volPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to grow %s filesystem on %s: %v", fsType, device, err)
+	}
+
+	glog.V(5).Infof("expanded volume %s (%s) to %d bytes", vID, device, requiredBytes)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: requiredBytes}, nil
+}
+
+// volumeCondition reports whether path (and the disk backing it) looks readable and
+// writable. A best-effort probe only; it never fails the calling RPC.
+func (n *NodeServer) volumeCondition(path string) *csi.VolumeCondition {
+	device, readOnly, err := mountInfoForPath(path)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: err.Error()}
+	}
+
+	// kubelet polls NodeGetVolumeStats for every mounted volume, including ones
+	// published read-only, so the write half of the probe must be skipped there -
+	// otherwise a perfectly healthy read-only volume would fail EROFS/EACCES forever.
+	if err := probeReadWrite(path, readOnly); err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("%s failed a read/write probe: %v", path, err)}
+	}
+
+	if healthy, err := smartHealthy(device); err == nil && !healthy {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("device %s failed its SMART health check", device)}
+	}
+
+	if state, err := os.ReadFile(sysBlockStatePath(device)); err == nil {
+		if s := strings.TrimSpace(string(state)); s != "" && s != "running" {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("device %s reports state %q", device, s)}
+		}
+	}
+
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// probeReadWrite does a best-effort, non-destructive check that path is actually usable:
+// for a directory (mount volumes) it lists entries and, unless readOnly, round-trips a
+// throwaway file; for anything else (block volumes, where path is the published device
+// node) it opens the path for reading, and for writing too unless readOnly.
+func probeReadWrite(path string, readOnly bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		flags := os.O_RDWR
+		if readOnly {
+			flags = os.O_RDONLY
+		}
+		f, err := os.OpenFile(path, flags, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	if _, err := os.ReadDir(path); err != nil {
+		return err
+	}
+
+	if readOnly {
+		return nil
+	}
+
+	probe, err := os.CreateTemp(path, ".condition-probe-*")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	return os.Remove(name)
+}
+
+// smartHealthy runs `smartctl -H` against device and reports its overall-health
+// self-assessment. err is non-nil when smartctl itself couldn't run (missing binary,
+// unsupported device such as a dm-crypt/loop mapping) — callers should treat that as
+// "unknown" rather than unhealthy, since plenty of valid backing devices don't support
+// SMART at all.
+func smartHealthy(device string) (bool, error) {
+	out, err := exec.Command("smartctl", "-H", device).CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return false, err
+		}
+	}
+	return !strings.Contains(string(out), "FAILED"), nil
+}
+
+// deviceForPath looks up the mount source backing path by scanning /proc/mounts for its
+// longest-matching mount point, so it also resolves the bind mount of a staged
+// filesystem. For a bind-mounted device node the mount source is the filesystem that
+// holds the node (e.g. devtmpfs), not the device itself.
+func deviceForPath(path string) (string, error) {
+	device, _, err := mountInfoForPath(path)
+	return device, err
+}
+
+// mountInfoForPath scans /proc/mounts the same way deviceForPath does, additionally
+// reporting whether the longest-matching mount point was mounted read-only (the "ro"
+// mount option), since Bind remounts MS_RDONLY for volumes published read-only.
+func mountInfoForPath(path string) (device string, readOnly bool, err error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	var longestMountPoint string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		src, mountPoint, opts := fields[0], fields[1], fields[3]
+		matches := path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+		if matches && len(mountPoint) > len(longestMountPoint) {
+			longestMountPoint = mountPoint
+			device = src
+			readOnly = isReadOnlyMountOpt(opts)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+	if device == "" {
+		return "", false, fmt.Errorf("no mount entry found for %s", path)
+	}
+	return device, readOnly, nil
+}
+
+func isReadOnlyMountOpt(opts string) bool {
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+func sysBlockStatePath(device string) string {
+	return fmt.Sprintf("/sys/block/%s/device/state", strings.TrimPrefix(device, "/dev/"))
+}
+
+// blockDeviceSize returns the size in bytes of the block device at device via the
+// BLKGETSIZE64 ioctl.
+func blockDeviceSize(device string) (int64, error) {
+	fd, err := unix.Open(device, unix.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+func filesystemType(device string) (string, error) {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", device).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("blkid %s: %v: %s", device, err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// resizeLuksMapping grows dm-crypt's view of an already-open LUKS mapping to match its
+// (now larger) backing device, so a subsequent filesystem resize has the extra space to
+// claim.
+func resizeLuksMapping(mapperName string) error {
+	out, err := exec.Command("cryptsetup", "resize", mapperName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup resize %s: %v: %s", mapperName, err, out)
+	}
+	return nil
+}
+
+func growFilesystem(fsType, device, mountPoint string) error {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return exec.Command("resize2fs", device).Run()
+	case "xfs":
+		// xfs_growfs operates on the mount point, not the device, since XFS can only be
+		// grown while mounted.
+		return exec.Command("xfs_growfs", mountPoint).Run()
+	default:
+		return fmt.Errorf("unsupported filesystem %q for online expansion", fsType)
+	}
+}